@@ -2,12 +2,13 @@ package cli
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net"
 	"os"
 	"sync"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/miekg/dns"
 	"github.com/spf13/cobra"
+	"golang.org/x/time/rate"
 )
 
 const ResolverRetries = 5
@@ -34,11 +36,32 @@ var Resolvers = []string{
 	"208.67.220.220",
 }
 
-func resolver() string {
-	return Resolvers[rand.Int()%len(Resolvers)]
+// resolveType issues a single qtype query, applying opts' EDNS(0) options.
+// A non-success rcode (e.g. SERVFAIL) is surfaced as an error naming the
+// rcode, so isTransient can recognize a resolver hiccup and retry it even
+// outside the DNSSEC path below. If the response comes back SERVFAIL and
+// DNSSEC validation was requested, it additionally retries once with CD=1
+// to tell a broken-but-not-compromised zone apart from a generic resolution
+// failure.
+func resolveType(pool *ResolverPool, domain string, qtype uint16, opts resolveOptions) ([]string, []string, dnssecStatus, error) {
+	status := dnssecStatus{Requested: opts.DNSSEC}
+	ips, tried, in, err := exchangeType(pool, domain, qtype, opts, false)
+	if opts.DNSSEC && in != nil {
+		status.AD = in.AuthenticatedData
+	}
+	if err != nil && opts.DNSSEC && in != nil && in.Rcode == dns.RcodeServerFailure {
+		status.CDRetried = true
+		var retriedTried []string
+		ips, retriedTried, in, err = exchangeType(pool, domain, qtype, opts, true)
+		tried = append(tried, retriedTried...)
+		if err == nil {
+			status.ValidationFailed = true
+		}
+	}
+	return ips, tried, status, err
 }
 
-func resolve(domain string) ([]string, error) {
+func exchangeType(pool *ResolverPool, domain string, qtype uint16, opts resolveOptions, cd bool) ([]string, []string, *dns.Msg, error) {
 	ma := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			Id:               dns.Id(),
@@ -47,34 +70,29 @@ func resolve(domain string) ([]string, error) {
 		Question: []dns.Question{
 			dns.Question{
 				Name:   domain + ".",
-				Qtype:  dns.TypeA,
+				Qtype:  qtype,
 				Qclass: dns.ClassINET,
 			},
 		},
 	}
-	c := &dns.Client{}
-	var in *dns.Msg
-	resolvers := []string{}
-	for {
-		var err error
-		res := resolver()
-		resolvers = append(resolvers, res)
-		in, _, err = c.Exchange(ma, fmt.Sprintf("%s:53", res))
-		if err == nil || len(resolvers) >= ResolverRetries {
-			break
-		}
-		time.Sleep(100 * time.Duration(len(resolvers)) * time.Millisecond)
-	}
+	applyEDNS(ma, opts, cd)
+	in, tried, err := pool.exchange(ma)
 	if in == nil {
-		return nil, fmt.Errorf(
+		return nil, tried, nil, fmt.Errorf(
 			"failed to resolve after %d retries on %v: %s",
-			len(resolvers),
-			resolvers,
+			len(tried),
+			tried,
 			domain,
 		)
 	}
+	if err != nil {
+		return nil, tried, in, err
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, tried, in, fmt.Errorf("%s for %s", dns.RcodeToString[in.Rcode], domain)
+	}
 	if len(in.Answer) == 0 {
-		return nil, fmt.Errorf("empty DNS answer for %s", domain)
+		return nil, tried, in, fmt.Errorf("empty DNS answer for %s", domain)
 	}
 
 	ips := []string{}
@@ -82,49 +100,227 @@ func resolve(domain string) ([]string, error) {
 		switch v := a.(type) {
 		case *dns.A:
 			ips = append(ips, v.A.String())
+		case *dns.AAAA:
+			ips = append(ips, v.AAAA.String())
 		}
-		//TODO: Eventually add IPv6 support
 	}
 	if len(ips) == 0 {
-		return nil, fmt.Errorf("no A records for %s", domain)
+		return nil, tried, in, fmt.Errorf("no %s records for %s", dns.TypeToString[qtype], domain)
+	}
+	return ips, tried, in, nil
+}
+
+// resolve looks up A records only, with no EDNS(0) options. Nothing in this
+// package calls it; probeHttps resolves through resolveDual.
+func resolve(pool *ResolverPool, domain string) ([]string, error) {
+	ips, _, _, err := resolveType(pool, domain, dns.TypeA, resolveOptions{})
+	return ips, err
+}
+
+// resolveDual looks up A and AAAA in parallel per RFC 8305 (Happy Eyeballs
+// v2): both queries fire at once, but we only wait aaaaResolutionDelay for
+// AAAA before giving up on it and returning the A-only results. The
+// addresses are then ordered according to prefer, with the preferred family
+// first. It also returns every resolver that was consulted and the merged
+// DNSSEC status, for diagnostics.
+func resolveDual(pool *ResolverPool, domain string, prefer string, opts resolveOptions) ([]string, []string, dnssecStatus, error) {
+	type result struct {
+		ips    []string
+		tried  []string
+		dnssec dnssecStatus
+		err    error
+	}
+	aCh := make(chan result, 1)
+	aaaaCh := make(chan result, 1)
+	go func() {
+		ips, tried, dnssec, err := resolveType(pool, domain, dns.TypeA, opts)
+		aCh <- result{ips, tried, dnssec, err}
+	}()
+	go func() {
+		ips, tried, dnssec, err := resolveType(pool, domain, dns.TypeAAAA, opts)
+		aaaaCh <- result{ips, tried, dnssec, err}
+	}()
+
+	var aRes, aaaaRes result
+	haveA, haveAAAA := false, false
+	select {
+	case aRes = <-aCh:
+		haveA = true
+	case aaaaRes = <-aaaaCh:
+		haveAAAA = true
+	}
+	if !haveAAAA {
+		select {
+		case aaaaRes = <-aaaaCh:
+			haveAAAA = true
+		case <-time.After(aaaaResolutionDelay):
+		}
+	}
+	if !haveA {
+		aRes = <-aCh
+		haveA = true
+	}
+
+	resolvers := append(append([]string{}, aRes.tried...), aaaaRes.tried...)
+	status := mergeDNSSECStatus(aRes.dnssec, aaaaRes.dnssec)
+
+	v4, v6 := aRes.ips, aaaaRes.ips
+	if len(v4) == 0 && len(v6) == 0 {
+		if aRes.err != nil {
+			return nil, resolvers, status, aRes.err
+		}
+		return nil, resolvers, status, aaaaRes.err
+	}
+
+	switch prefer {
+	case "v4":
+		return append(v4, v6...), resolvers, status, nil
+	case "v6":
+		if len(v6) == 0 {
+			return v4, resolvers, status, nil
+		}
+		return append(v6, v4...), resolvers, status, nil
+	default: // "auto"
+		return interleave(v6, v4), resolvers, status, nil
 	}
-	return ips, nil
 }
 
-func probeHttps(dialer *net.Dialer, domain string, debug bool) error {
-	ips, err := resolve(domain)
+// interleave merges two address lists alternately, preserving the order of
+// each list and starting with the first one (v6 first, in our usage).
+func interleave(first, second []string) []string {
+	out := make([]string, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// aaaaResolutionDelay is the RFC 8305 "resolution delay": how long we'll
+// wait for AAAA to come back before proceeding with A-only addresses.
+const aaaaResolutionDelay = 50 * time.Millisecond
+
+// connectionAttemptDelay staggers successive connection attempts in the
+// Happy Eyeballs dial race.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// dialResult carries a single racer's outcome back to probeHttps.
+type dialResult struct {
+	ip   string
+	conn *tls.Conn
+	err  error
+	rtt  time.Duration
+}
+
+// probeHttps resolves domain for both address families and races TLS dials
+// against the resulting addresses per RFC 8305, returning as soon as one
+// succeeds and cancelling the rest. The returned DomainRecord always carries
+// whatever diagnostics were gathered, even on failure; the error return
+// mirrors the historical plain-mode contract (nil only on a successful
+// handshake).
+func probeHttps(pool *ResolverPool, dialer *net.Dialer, domain string, debug bool, prefer string, opts resolveOptions) (*DomainRecord, error) {
+	rec := &DomainRecord{Domain: domain}
+
+	ips, resolvers, dnssec, err := resolveDual(pool, domain, prefer, opts)
+	rec.Addresses = ips
+	rec.Resolvers = resolvers
+	if opts.DNSSEC {
+		rec.DNSSEC = &DNSSECInfo{
+			AD:               dnssec.AD,
+			CDRetried:        dnssec.CDRetried,
+			ValidationFailed: dnssec.ValidationFailed,
+		}
+	}
 	if err != nil {
-		return err
+		rec.Error = err.Error()
+		return rec, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan dialResult, len(ips))
+	for i, ip := range ips {
+		go func(i int, ip string) {
+			t := time.NewTimer(time.Duration(i) * connectionAttemptDelay)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+			start := time.Now()
+			rawConn, err := dialer.DialContext(ctx, "tcp", ip+":443")
+			if err != nil {
+				results <- dialResult{ip: ip, err: err, rtt: time.Since(start)}
+				return
+			}
+			conn := tls.Client(rawConn, &tls.Config{ServerName: domain})
+			if err := conn.HandshakeContext(ctx); err != nil {
+				rawConn.Close()
+				results <- dialResult{ip: ip, err: err, rtt: time.Since(start)}
+				return
+			}
+			rtt := time.Since(start)
+			select {
+			case results <- dialResult{ip: ip, conn: conn, rtt: rtt}:
+			case <-ctx.Done():
+				conn.Close()
+			}
+		}(i, ip)
 	}
+
 	var lastErr error
-	for _, ip := range ips {
-		if debug && lastErr != nil {
-			fmt.Fprintln(os.Stderr, lastErr)
-		}
-		conn, err := tls.DialWithDialer(
-			dialer,
-			"tcp",
-			ip+":443",
-			&tls.Config{ServerName: domain},
-		)
-		if err != nil {
-			lastErr = fmt.Errorf("%s on %s: %s", domain, ip, err)
+	for range ips {
+		r := <-results
+		if r.err != nil {
+			if debug {
+				fmt.Fprintln(os.Stderr, fmt.Errorf("%s on %s: %s", domain, r.ip, r.err))
+			}
+			lastErr = r.err
+			rec.Dials = append(rec.Dials, DialOutcome{
+				IP:    r.ip,
+				Error: r.err.Error(),
+				RTTMs: r.rtt.Milliseconds(),
+			})
 			continue
 		}
-		if err := conn.Close(); err != nil {
+		rec.Dials = append(rec.Dials, DialOutcome{
+			IP:      r.ip,
+			Success: true,
+			RTTMs:   r.rtt.Milliseconds(),
+		})
+		rec.TLS = tlsInfoFromConn(r.conn)
+		rec.Certificate = certInfoFromConn(r.conn)
+		if err := r.conn.Close(); err != nil {
 			// we swallow this one, as long as establishment is working we are good.
 			if debug {
-				fmt.Fprintf(os.Stderr, "%s on %s: error on close, %s", domain, ip, err)
+				fmt.Fprintf(os.Stderr, "%s on %s: error on close, %s", domain, r.ip, err)
 			}
 		}
-		return nil
+		return rec, nil
 	}
-	return lastErr
+	rec.Error = lastErr.Error()
+	return rec, lastErr
 }
 
 func domainsCommand() *cobra.Command {
 	var concurrency *int
 	var debug *bool
+	var resolverMode *string
+	var resolverFlags *[]string
+	var resolverConcurrency *int
+	var prefer *string
+	var format *string
+	var qps *float64
+	var maxRetries *int
+	var checkpointPath *string
+	var ednsClientSubnet *string
+	var dnssec *bool
 	cmd := &cobra.Command{
 		Use:   "domains path",
 		Short: "reads a domain file and emits clean URLs",
@@ -135,6 +331,45 @@ func domainsCommand() *cobra.Command {
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			mode := ResolverMode(*resolverMode)
+			switch mode {
+			case ResolverModeUDP, ResolverModeDoT, ResolverModeDoH:
+			default:
+				return fmt.Errorf("invalid --resolver-mode %q, want udp, dot or doh", *resolverMode)
+			}
+			pool, err := newResolverPool(mode, *resolverFlags, *resolverConcurrency)
+			if err != nil {
+				return err
+			}
+			switch *prefer {
+			case "v4", "v6", "auto":
+			default:
+				return fmt.Errorf("invalid --prefer %q, want v4, v6 or auto", *prefer)
+			}
+			outFormat := OutputFormat(*format)
+			switch outFormat {
+			case FormatPlain, FormatJSON, FormatJSONL:
+			default:
+				return fmt.Errorf("invalid --format %q, want plain, json or jsonl", *format)
+			}
+			opts := resolveOptions{DNSSEC: *dnssec}
+			if *ednsClientSubnet != "" {
+				ecs, err := parseECS(*ednsClientSubnet)
+				if err != nil {
+					return err
+				}
+				opts.ECS = ecs
+			}
+			var limiter *rate.Limiter
+			if *qps > 0 {
+				limiter = rate.NewLimiter(rate.Limit(*qps), 1)
+			}
+			cp, err := loadCheckpoint(*checkpointPath)
+			if err != nil {
+				return err
+			}
+			defer cp.Close()
+
 			f, err := os.Open(args[0])
 			if err != nil {
 				return err
@@ -143,6 +378,10 @@ func domainsCommand() *cobra.Command {
 			log.SetOutput(ioutil.Discard)
 			var wg sync.WaitGroup
 			ch := make(chan string, *concurrency)
+			records := make(chan *DomainRecord, *concurrency)
+			prog := &progress{}
+			stopProgress := make(chan struct{})
+			go prog.report(5*time.Second, stopProgress)
 			for i := 0; i < *concurrency; i++ {
 				dialer := &net.Dialer{
 					Timeout:       10 * time.Second,
@@ -152,35 +391,68 @@ func domainsCommand() *cobra.Command {
 				go func() {
 					defer wg.Done()
 					for domain := range ch {
-						current := domain
-						err := probeHttps(dialer, current, *debug)
+						rec, err := probeWithRetry(limiter, pool, dialer, domain, *debug, *prefer, *maxRetries, opts)
+						host := rec.Domain
 						if err != nil {
-							if *debug {
-								fmt.Fprintln(os.Stderr, err)
+							rec.URL = fmt.Sprintf("http://%s/", domain)
+							if len(rec.Addresses) == 0 {
+								prog.recordFailure()
+							} else {
+								prog.recordSuccess(false)
 							}
-							current = "www." + domain
-							err = probeHttps(dialer, current, *debug)
-						}
-						if err != nil {
-							if *debug {
-								fmt.Fprintln(os.Stderr, err)
-							}
-							fmt.Printf("http://%s/\n", domain)
 						} else {
-							fmt.Printf("https://%s/\n", current)
+							rec.URL = fmt.Sprintf("https://%s/", host)
+							prog.recordSuccess(true)
 						}
+						rec.Domain = domain
+						if err := cp.markDone(domain); err != nil && *debug {
+							fmt.Fprintln(os.Stderr, err)
+						}
+						records <- rec
 					}
 				}()
 			}
-			for true {
-				t, _, _ := r.ReadLine()
-				if len(t) == 0 {
-					break
+			go func() {
+				for true {
+					t, _, _ := r.ReadLine()
+					if len(t) == 0 {
+						break
+					}
+					domain := string(t)
+					if cp.isDone(domain) {
+						continue
+					}
+					ch <- domain
+				}
+				close(ch)
+			}()
+			go func() {
+				wg.Wait()
+				close(stopProgress)
+				close(records)
+			}()
+
+			switch outFormat {
+			case FormatJSON:
+				all := []*DomainRecord{}
+				for rec := range records {
+					all = append(all, rec)
+				}
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(all)
+			case FormatJSONL:
+				enc := json.NewEncoder(os.Stdout)
+				for rec := range records {
+					if err := enc.Encode(rec); err != nil {
+						return err
+					}
+				}
+			default: // plain
+				for rec := range records {
+					fmt.Println(rec.URL)
 				}
-				ch <- string(t)
 			}
-			close(ch)
-			wg.Wait()
 			return nil
 		},
 	}
@@ -190,5 +462,45 @@ func domainsCommand() *cobra.Command {
 	debug = cmd.Flags().Bool(
 		"debug", false, "Debugging output",
 	)
+	resolverMode = cmd.Flags().String(
+		"resolver-mode", string(ResolverModeUDP),
+		"DNS transport to use: udp, dot or doh",
+	)
+	resolverFlags = cmd.Flags().StringArray(
+		"resolver", nil,
+		"Resolver to use, e.g. 8.8.8.8, tls://1.1.1.1@one.one.one.one or https://cloudflare-dns.com/dns-query; repeatable",
+	)
+	resolverConcurrency = cmd.Flags().Int(
+		"resolver-concurrency", defaultResolverConcurrency,
+		"Max in-flight queries against any single resolver",
+	)
+	prefer = cmd.Flags().String(
+		"prefer", "auto",
+		"Address family to prefer when dialing: v6, v4 or auto (Happy Eyeballs v2)",
+	)
+	format = cmd.Flags().String(
+		"format", string(FormatPlain),
+		"Output format: plain, json (one array) or jsonl (one object per line)",
+	)
+	qps = cmd.Flags().Float64(
+		"qps", 0,
+		"Global rate limit on probes per second, 0 for unlimited",
+	)
+	maxRetries = cmd.Flags().Int(
+		"max-retries", 2,
+		"Retries for transient probe failures, with exponential backoff and full jitter",
+	)
+	checkpointPath = cmd.Flags().String(
+		"checkpoint", "",
+		"Path to a checkpoint file recording completed domains, so a re-run can skip them",
+	)
+	ednsClientSubnet = cmd.Flags().String(
+		"edns-client-subnet", "",
+		"Attach an EDNS Client Subnet option, e.g. 203.0.113.0/24",
+	)
+	dnssec = cmd.Flags().Bool(
+		"dnssec", false,
+		"Set the DNSSEC OK bit and record AD status; retry SERVFAILs with CD=1 to detect a broken zone",
+	)
 	return cmd
 }
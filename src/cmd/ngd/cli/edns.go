@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ednsUDPSize is the UDP payload size we advertise via EDNS(0); resolvers
+// use it to decide whether to truncate or switch to TCP.
+const ednsUDPSize = 4096
+
+// resolveOptions bundles the EDNS(0) behavior requested for a resolution,
+// so resolveType/resolveDual don't have to grow a new positional parameter
+// for every extension.
+type resolveOptions struct {
+	ECS    *dns.EDNS0_SUBNET
+	DNSSEC bool
+}
+
+// parseECS turns a --edns-client-subnet value like "203.0.113.0/24" or
+// "2001:db8::/32" into the EDNS0 Client Subnet option RFC 7871 describes.
+// The ADDRESS field sent is the masked network address (ipnet.IP), not the
+// host address the user typed, since RFC 7871 requires the bits beyond
+// SOURCE PREFIX-LENGTH to be zero.
+func parseECS(cidr string) (*dns.EDNS0_SUBNET, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --edns-client-subnet %q: %s", cidr, err)
+	}
+	ones, _ := ipnet.Mask.Size()
+	family := uint16(1)
+	addr := ipnet.IP.To4()
+	if addr == nil {
+		family = 2
+		addr = ipnet.IP.To16()
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(ones),
+		SourceScope:   0,
+		Address:       addr,
+	}, nil
+}
+
+// applyEDNS attaches an OPT pseudo-RR to msg per opts: the DO bit for
+// --dnssec, CD when cd is true (used for the SERVFAIL retry), and the ECS
+// option when one was configured.
+func applyEDNS(msg *dns.Msg, opts resolveOptions, cd bool) {
+	if !opts.DNSSEC && opts.ECS == nil {
+		return
+	}
+	msg.SetEdns0(ednsUDPSize, opts.DNSSEC)
+	if opts.DNSSEC {
+		msg.CheckingDisabled = cd
+	}
+	if opts.ECS != nil {
+		o := msg.IsEdns0()
+		o.Option = append(o.Option, opts.ECS)
+	}
+}
+
+// dnssecStatus carries the DNSSEC diagnostics for one resolution, surfaced
+// in DomainRecord so callers can tell a validation failure apart from a
+// generic resolution failure.
+type dnssecStatus struct {
+	Requested        bool
+	AD               bool
+	CDRetried        bool
+	ValidationFailed bool
+}
+
+func mergeDNSSECStatus(a, b dnssecStatus) dnssecStatus {
+	return dnssecStatus{
+		Requested:        a.Requested || b.Requested,
+		AD:               a.AD || b.AD,
+		CDRetried:        a.CDRetried || b.CDRetried,
+		ValidationFailed: a.ValidationFailed || b.ValidationFailed,
+	}
+}
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+)
+
+// OutputFormat selects how domainsCommand renders its results.
+type OutputFormat string
+
+const (
+	FormatPlain OutputFormat = "plain"
+	FormatJSON  OutputFormat = "json"
+	FormatJSONL OutputFormat = "jsonl"
+)
+
+// DialOutcome records the result of a single TLS dial attempt against one
+// resolved address.
+type DialOutcome struct {
+	IP      string `json:"ip"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	RTTMs   int64  `json:"rtt_ms"`
+}
+
+// TLSInfo describes the negotiated parameters of a successful TLS handshake.
+type TLSInfo struct {
+	Version string `json:"version"`
+	Cipher  string `json:"cipher"`
+	ALPN    string `json:"alpn,omitempty"`
+}
+
+// CertInfo summarizes the leaf certificate presented by the server.
+type CertInfo struct {
+	Subject  string    `json:"subject"`
+	SANs     []string  `json:"sans,omitempty"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// DNSSECInfo reports the DNSSEC diagnostics gathered while resolving a
+// domain, present only when --dnssec was requested.
+type DNSSECInfo struct {
+	AD               bool `json:"ad"`
+	CDRetried        bool `json:"cd_retried,omitempty"`
+	ValidationFailed bool `json:"validation_failed,omitempty"`
+}
+
+// DomainRecord is the structured result of probing a single input domain,
+// emitted as one JSON object per domain in --format json/jsonl.
+type DomainRecord struct {
+	Domain      string        `json:"domain"`
+	Addresses   []string      `json:"addresses,omitempty"`
+	Resolvers   []string      `json:"resolvers,omitempty"`
+	Dials       []DialOutcome `json:"dials,omitempty"`
+	URL         string        `json:"url"`
+	TLS         *TLSInfo      `json:"tls,omitempty"`
+	Certificate *CertInfo     `json:"certificate,omitempty"`
+	DNSSEC      *DNSSECInfo   `json:"dnssec,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// tlsVersionName maps the handful of versions Go's crypto/tls negotiates to
+// their wire names; there's no exported helper for this in older Go
+// releases so we keep our own small table.
+var tlsVersionName = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
+}
+
+func tlsInfoFromConn(conn *tls.Conn) *TLSInfo {
+	state := conn.ConnectionState()
+	return &TLSInfo{
+		Version: tlsVersionName[state.Version],
+		Cipher:  tls.CipherSuiteName(state.CipherSuite),
+		ALPN:    state.NegotiatedProtocol,
+	}
+}
+
+func certInfoFromConn(conn *tls.Conn) *CertInfo {
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	return &CertInfo{
+		Subject:  cert.Subject.String(),
+		SANs:     sanNames(cert),
+		NotAfter: cert.NotAfter,
+	}
+}
+
+func sanNames(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.IPAddresses))
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
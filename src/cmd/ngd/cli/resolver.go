@@ -0,0 +1,279 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ResolverMode selects which DNS transport a Resolver pool uses for bare
+// resolver addresses; tls:// and https:// entries keep their own transport.
+type ResolverMode string
+
+const (
+	ResolverModeUDP ResolverMode = "udp"
+	ResolverModeDoT ResolverMode = "dot"
+	ResolverModeDoH ResolverMode = "doh"
+)
+
+// resolverClientTimeout bounds a single exchange on any transport.
+const resolverClientTimeout = 5 * time.Second
+
+// Resolver performs a single DNS exchange over some transport.
+type Resolver interface {
+	Exchange(msg *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+// udpResolver speaks classic UDP/53 DNS, same as the original resolve().
+type udpResolver struct {
+	addr string
+}
+
+func (r *udpResolver) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{Timeout: resolverClientTimeout}
+	in, _, err := c.Exchange(msg, fmt.Sprintf("%s:53", r.addr))
+	return in, err
+}
+
+func (r *udpResolver) String() string {
+	return "udp://" + r.addr
+}
+
+// dotResolver speaks DNS-over-TLS (RFC 7858) to addr:853, verifying the
+// certificate chain and hostname against serverName, plus the leaf's SPKI
+// fingerprint against spkiPin when one is configured.
+type dotResolver struct {
+	addr       string
+	serverName string
+	spkiPin    []byte
+}
+
+func (r *dotResolver) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{
+		Net:     "tcp-tls",
+		Timeout: resolverClientTimeout,
+		TLSConfig: &tls.Config{
+			ServerName:            r.serverName,
+			MinVersion:            tls.VersionTLS12,
+			VerifyPeerCertificate: r.verifySPKI,
+		},
+	}
+	in, _, err := c.Exchange(msg, fmt.Sprintf("%s:853", r.addr))
+	return in, err
+}
+
+// verifySPKI checks the leaf certificate's SHA-256 SPKI fingerprint against
+// r.spkiPin. It runs in addition to (not instead of) the standard chain and
+// hostname verification crypto/tls already performed; it's a no-op when no
+// pin was configured.
+func (r *dotResolver) verifySPKI(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(r.spkiPin) == 0 {
+		return nil
+	}
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("dot: %s: no peer certificate to verify pin against", r.addr)
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("dot: %s: parse leaf certificate: %s", r.addr, err)
+	}
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	if !bytes.Equal(sum[:], r.spkiPin) {
+		return fmt.Errorf("dot: %s: SPKI pin mismatch, got %x", r.addr, sum)
+	}
+	return nil
+}
+
+func (r *dotResolver) String() string {
+	if len(r.spkiPin) == 0 {
+		return "tls://" + r.addr + "@" + r.serverName
+	}
+	return "tls://" + r.addr + "@" + r.serverName + "#" + hex.EncodeToString(r.spkiPin)
+}
+
+// dohResolver speaks DNS-over-HTTPS (RFC 8484) against a resolver URL such
+// as https://cloudflare-dns.com/dns-query, using the application/dns-message
+// POST form.
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHResolver(url string) *dohResolver {
+	return &dohResolver{
+		url: url,
+		client: &http.Client{
+			Timeout: resolverClientTimeout,
+		},
+	}
+}
+
+func (r *dohResolver) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("doh: pack query: %s", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, fmt.Errorf("doh: build request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("doh: %s: %s", r.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: %s: unexpected status %s", r.url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("doh: %s: read response: %s", r.url, err)
+	}
+	in := &dns.Msg{}
+	if err := in.Unpack(body); err != nil {
+		return nil, fmt.Errorf("doh: %s: unpack response: %s", r.url, err)
+	}
+	if in.Id != msg.Id {
+		return nil, dns.ErrId
+	}
+	return in, nil
+}
+
+func (r *dohResolver) String() string {
+	return r.url
+}
+
+// parseResolver parses a --resolver entry. Accepted forms:
+//
+//	1.1.1.1                                      plain address, used with --resolver-mode
+//	tls://1.1.1.1@one.one.one.one                 DoT, dialing the IP but verifying the name
+//	tls://1.1.1.1@one.one.one.one#<sha256-spki>   DoT, additionally pinning the leaf's SPKI (hex-encoded)
+//	https://cloudflare-dns.com/dns-query          DoH endpoint
+func parseResolver(mode ResolverMode, spec string) (Resolver, error) {
+	switch {
+	case strings.HasPrefix(spec, "https://"):
+		return newDoHResolver(spec), nil
+	case strings.HasPrefix(spec, "tls://"):
+		rest := strings.TrimPrefix(spec, "tls://")
+		hostPart, pinHex, hasPin := strings.Cut(rest, "#")
+		addr, name, ok := strings.Cut(hostPart, "@")
+		if !ok {
+			return nil, fmt.Errorf("dot resolver %q must be tls://ip@hostname", spec)
+		}
+		r := &dotResolver{addr: addr, serverName: name}
+		if hasPin {
+			pin, err := hex.DecodeString(pinHex)
+			if err != nil {
+				return nil, fmt.Errorf("dot resolver %q: invalid SPKI pin: %s", spec, err)
+			}
+			r.spkiPin = pin
+		}
+		return r, nil
+	default:
+		switch mode {
+		case ResolverModeDoH:
+			return newDoHResolver(spec), nil
+		case ResolverModeDoT:
+			return &dotResolver{addr: spec, serverName: spec}, nil
+		default:
+			return &udpResolver{addr: spec}, nil
+		}
+	}
+}
+
+// defaultResolverConcurrency is how many in-flight exchanges we allow
+// against a single resolver when the caller doesn't set --resolver-concurrency.
+const defaultResolverConcurrency = 10
+
+// resolverSlot pairs a resolver with a semaphore bounding how many exchanges
+// may be in flight against it at once.
+type resolverSlot struct {
+	resolver Resolver
+	sem      chan struct{}
+}
+
+func newResolverSlot(r Resolver, concurrency int) resolverSlot {
+	return resolverSlot{resolver: r, sem: make(chan struct{}, concurrency)}
+}
+
+// ResolverPool holds a set of resolvers and retries across them when one
+// fails, mixing transports when tls:// or https:// entries are given, mirroring the retry loop the UDP-only
+// resolve() used to do inline. Each resolver has its own concurrency cap so
+// a handful of slow resolvers can't starve the others.
+type ResolverPool struct {
+	Mode  ResolverMode
+	slots []resolverSlot
+}
+
+// newResolverPool builds a pool from --resolver-mode, --resolver and
+// --resolver-concurrency flag values. With no explicit --resolver entries it
+// falls back to the default UDP pool, which is only meaningful for
+// --resolver-mode udp: the Resolvers list is bare IPs with no DoH URL or DoT
+// hostname to reinterpret them as, so doh/dot require at least one
+// --resolver.
+func newResolverPool(mode ResolverMode, specs []string, concurrency int) (*ResolverPool, error) {
+	if len(specs) == 0 {
+		if mode != ResolverModeUDP && mode != "" {
+			return nil, fmt.Errorf("--resolver-mode %s requires at least one --resolver", mode)
+		}
+		return buildResolverPool(ResolverModeUDP, Resolvers, concurrency), nil
+	}
+	pool := &ResolverPool{Mode: mode}
+	for _, spec := range specs {
+		r, err := parseResolver(mode, spec)
+		if err != nil {
+			return nil, err
+		}
+		pool.slots = append(pool.slots, newResolverSlot(r, concurrency))
+	}
+	return pool, nil
+}
+
+func buildResolverPool(mode ResolverMode, specs []string, concurrency int) *ResolverPool {
+	pool := &ResolverPool{Mode: mode}
+	for _, addr := range specs {
+		pool.slots = append(pool.slots, newResolverSlot(&udpResolver{addr: addr}, concurrency))
+	}
+	return pool
+}
+
+func (p *ResolverPool) pick() resolverSlot {
+	return p.slots[rand.Int()%len(p.slots)]
+}
+
+// exchange retries the query across up to ResolverRetries resolvers in the
+// pool, returning the first successful answer. It blocks until a slot opens
+// up on whichever resolver it picks, enforcing the per-resolver concurrency
+// cap.
+func (p *ResolverPool) exchange(msg *dns.Msg) (*dns.Msg, []string, error) {
+	var in *dns.Msg
+	var lastErr error
+	tried := []string{}
+	for len(tried) < ResolverRetries {
+		slot := p.pick()
+		tried = append(tried, slot.resolver.String())
+		slot.sem <- struct{}{}
+		var err error
+		in, err = slot.resolver.Exchange(msg)
+		<-slot.sem
+		if err == nil {
+			return in, tried, nil
+		}
+		lastErr = err
+		time.Sleep(100 * time.Duration(len(tried)) * time.Millisecond)
+	}
+	return nil, tried, lastErr
+}
@@ -0,0 +1,219 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// backoffBase and backoffMax bound the exponential backoff (with full
+// jitter, per the AWS architecture blog algorithm) applied between retries
+// of a transient probe failure.
+const (
+	backoffBase = 200 * time.Millisecond
+	backoffMax  = 10 * time.Second
+)
+
+// backoff returns a jittered delay for the given (zero-based) retry attempt.
+func backoff(attempt int) time.Duration {
+	d := backoffBase << uint(attempt)
+	if d > backoffMax || d <= 0 {
+		d = backoffMax
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// isTransient reports whether err is worth retrying: a timeout, a dropped
+// connection, or a SERVFAIL-style resolution hiccup, as opposed to a
+// permanent NXDOMAIN/no-answer result.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, marker := range []string{
+		"timeout",
+		"i/o timeout",
+		"EOF",
+		"connection reset",
+		"failed to resolve after",
+		"SERVFAIL",
+	} {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// progress tracks running totals for the periodic stderr status line.
+type progress struct {
+	okHTTPS int64
+	okHTTP  int64
+	failed  int64
+	probes  int64
+}
+
+func (p *progress) recordSuccess(viaHTTPS bool) {
+	atomic.AddInt64(&p.probes, 1)
+	if viaHTTPS {
+		atomic.AddInt64(&p.okHTTPS, 1)
+	} else {
+		atomic.AddInt64(&p.okHTTP, 1)
+	}
+}
+
+func (p *progress) recordFailure() {
+	atomic.AddInt64(&p.probes, 1)
+	atomic.AddInt64(&p.failed, 1)
+}
+
+// report prints one status line to stderr every interval until stop is
+// closed, then prints a final line.
+func (p *progress) report(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastProbes int64
+	print := func() {
+		probes := atomic.LoadInt64(&p.probes)
+		qps := float64(probes-lastProbes) / interval.Seconds()
+		lastProbes = probes
+		fmt.Fprintf(os.Stderr, "ok/https=%d ok/http=%d failed=%d qps=%.1f\n",
+			atomic.LoadInt64(&p.okHTTPS),
+			atomic.LoadInt64(&p.okHTTP),
+			atomic.LoadInt64(&p.failed),
+			qps,
+		)
+	}
+	for {
+		select {
+		case <-ticker.C:
+			print()
+		case <-stop:
+			print()
+			return
+		}
+	}
+}
+
+// checkpoint records which domains have already been probed, so a re-run
+// over the same input file can skip them. The file is a plain list of
+// completed domains, one per line, flushed as each domain finishes.
+type checkpoint struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]bool
+}
+
+// loadCheckpoint opens path for appending, reading any domains it already
+// lists. An empty path disables checkpointing entirely.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	if path == "" {
+		return &checkpoint{done: map[string]bool{}}, nil
+	}
+	c := &checkpoint{done: map[string]bool{}}
+	if existing, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				c.done[line] = true
+			}
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c.f = f
+	return c, nil
+}
+
+func (c *checkpoint) isDone(domain string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[domain]
+}
+
+func (c *checkpoint) markDone(domain string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	c.done[domain] = true
+	if _, err := fmt.Fprintln(c.f, domain); err != nil {
+		return err
+	}
+	return c.f.Sync()
+}
+
+func (c *checkpoint) Close() error {
+	if c.f == nil {
+		return nil
+	}
+	return c.f.Close()
+}
+
+// probeWithRetry tries domain, then www.domain, retrying transient failures
+// of either with exponential backoff+jitter up to maxRetries. limiter
+// enforces the global --qps cap across every attempt. If every candidate
+// fails, it returns the first (original domain's) DomainRecord rather than
+// the last one tried, so the resolution/dial diagnostics that went into the
+// JSON/JSONL output and the caller's progress accounting describe the
+// actual domain instead of whatever the www. fallback happened to produce.
+func probeWithRetry(
+	limiter *rate.Limiter,
+	pool *ResolverPool,
+	dialer *net.Dialer,
+	domain string,
+	debug bool,
+	prefer string,
+	maxRetries int,
+	opts resolveOptions,
+) (*DomainRecord, error) {
+	candidates := []string{domain, "www." + domain}
+	var firstRec *DomainRecord
+	var firstErr error
+	for i, current := range candidates {
+		var rec *DomainRecord
+		var err error
+		for attempt := 0; attempt <= maxRetries; attempt++ {
+			if limiter != nil {
+				limiter.Wait(context.Background())
+			}
+			rec, err = probeHttps(pool, dialer, current, debug, prefer, opts)
+			if err == nil || !isTransient(err) || attempt == maxRetries {
+				break
+			}
+			if debug {
+				fmt.Fprintf(os.Stderr, "%s: transient error, retry %d/%d: %s\n", current, attempt+1, maxRetries, err)
+			}
+			time.Sleep(backoff(attempt))
+		}
+		if i == 0 {
+			firstRec, firstErr = rec, err
+		}
+		if err == nil {
+			return rec, nil
+		}
+		if debug {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	return firstRec, firstErr
+}